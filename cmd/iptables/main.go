@@ -17,32 +17,15 @@ package main
 import (
 	"os"
 	"os/user"
-	"strings"
 
 	"github.com/spf13/cobra"
-	"istio.io/istio/tools/istio-iptables/pkg/builder"
-	iptablesconf "istio.io/istio/tools/istio-iptables/pkg/config"
-	"istio.io/istio/tools/istio-iptables/pkg/dependencies"
-	"istio.io/istio/tools/istio-iptables/pkg/log"
-)
 
-const (
-	InboundChain         = "APISIX_INBOUND"
-	RedirectChain        = "APISIX_REDIRECT"
-	InboundRedirectChain = "APISIX_INBOUND_REDIRECT"
-	OutputChain          = "OUTPUT"
-	PreRoutingChain      = "PREROUTING"
+	"github.com/api7/amesh/pkg/iptables"
 )
 
-type iptablesConstructor struct {
-	iptables *builder.IptablesBuilder
-	cfg      *iptablesconf.Config
-	dep      dependencies.Dependencies
-}
-
 func newCommand() *cobra.Command {
 	var (
-		cfg       iptablesconf.Config
+		cfg       iptables.Config
 		proxyUser string
 	)
 	cmd := &cobra.Command{
@@ -59,33 +42,24 @@ if outbound TCP traffic (say the destination port is 80) is desired to be interc
 
 --dry-run option can be specified if you just want to see which rules will be generated (but no effects).
 `,
-		Run: func(cmd *cobra.Command, args []string) {
-			var dep dependencies.Dependencies
-			if cfg.DryRun {
-				dep = &dependencies.StdoutStubDependencies{}
-			} else {
-				dep = &dependencies.RealDependencies{}
-			}
-
+		RunE: func(cmd *cobra.Command, args []string) error {
 			usr, err := user.Lookup(proxyUser)
 			if err != nil {
-				panic(err)
+				return err
 			}
 			cfg.ProxyUID = usr.Uid
 			cfg.ProxyGID = usr.Gid
 
-			ic := &iptablesConstructor{
-				iptables: builder.NewIptablesBuilder(&cfg),
-				cfg:      &cfg,
-				dep:      dep,
-			}
-
-			ic.run()
+			return iptables.Apply(cfg)
 		},
 	}
 
 	cmd.PersistentFlags().StringVar(&cfg.InboundInterceptionMode, "inbound-interception-mode", "REDIRECT",
-		"iptables mode to redirect inbound connections")
+		"iptables mode to redirect inbound connections, one of REDIRECT or TPROXY")
+	cmd.PersistentFlags().StringVar(&cfg.TproxyMark, "tproxy-mark", "0x400",
+		"the fwmark used to mark inbound packets for TPROXY interception, only effective when --inbound-interception-mode is TPROXY")
+	cmd.PersistentFlags().StringVar(&cfg.TproxyRouteTable, "tproxy-route-table", "100",
+		"the routing table id used by the policy routing rules installed for TPROXY mode, only effective when --inbound-interception-mode is TPROXY")
 	cmd.PersistentFlags().StringVar(&cfg.InboundCapturePort, "apisix-inbound-capture-port", "9081", "the target port where all inbound TCP traffic should be redirected on")
 	cmd.PersistentFlags().StringVar(&cfg.ProxyPort, "apisix-port", "9080", "the target port where all TCP traffic should be redirected on")
 	cmd.PersistentFlags().StringVar(&cfg.InboundPortsInclude, "inbound-ports", "",
@@ -93,118 +67,61 @@ if outbound TCP traffic (say the destination port is 80) is desired to be interc
 	cmd.PersistentFlags().StringVar(&cfg.OutboundPortsInclude, "outbound-ports", "", "comma separated list of outbound ports for which traffic is to be redirected")
 	cmd.PersistentFlags().StringVar(&cfg.InboundPortsExclude, "inbound-exclude-ports", "", "comma separated list of inbound ports to be excluded from forwarding to APISIX, only in effective if value of --inbound-ports option is \"*\"")
 	cmd.PersistentFlags().StringVar(&cfg.OutboundPortsExclude, "outbound-exclude-ports", "", "comma separated list of outbound ports to be excluded from forwarding to APISIX, only in effective if value of --outbound-ports option is \"*\"")
+	cmd.PersistentFlags().StringVar(&cfg.OutboundIPRangesInclude, "outbound-ip-ranges-include", "*",
+		"comma separated list of destination CIDRs for which outbound traffic is to be redirected, the wildcard character \"*\" redirects all destinations")
+	cmd.PersistentFlags().StringVar(&cfg.OutboundIPRangesExclude, "outbound-ip-ranges-exclude", "",
+		"comma separated list of destination CIDRs whose outbound traffic is never redirected to APISIX")
+	cmd.PersistentFlags().StringVar(&cfg.KubeVirtInterfaces, "kube-virt-interfaces", "",
+		"comma separated list of virtual interface names whose outbound traffic should bypass APISIX redirection entirely")
+	cmd.PersistentFlags().StringVar(&cfg.ExcludeUIDs, "exclude-uids", "",
+		"comma separated list of additional uids whose outbound traffic is never redirected to APISIX")
+	cmd.PersistentFlags().StringVar(&cfg.ExcludeGIDs, "exclude-gids", "",
+		"comma separated list of additional gids whose outbound traffic is never redirected to APISIX")
+
+	cmd.PersistentFlags().BoolVar(&cfg.EnableInboundIPv6, "enable-inbound-ipv6", false, "also generate and install ip6tables rules for inbound traffic")
+	cmd.PersistentFlags().BoolVar(&cfg.EnableOutboundIPv6, "enable-outbound-ipv6", false, "also generate and install ip6tables rules for outbound traffic")
+	cmd.PersistentFlags().BoolVar(&cfg.DualStack, "dual-stack", false, "shorthand for --enable-inbound-ipv6 and --enable-outbound-ipv6")
+
+	cmd.PersistentFlags().BoolVar(&cfg.RedirectDNS, "redirect-dns", false, "capture outbound DNS traffic and redirect it to the configured upstream resolver")
+	cmd.PersistentFlags().StringVar(&cfg.DNSUpstreamIP, "dns-upstream-ip", "127.0.0.1", "IP address of the local DNS resolver traffic is redirected to, only effective when --redirect-dns is set")
+	cmd.PersistentFlags().StringVar(&cfg.DNSUpstreamPort, "dns-upstream-port", "53", "port of the local DNS resolver traffic is redirected to, only effective when --redirect-dns is set")
 
 	cmd.PersistentFlags().BoolVar(&cfg.DryRun, "dry-run", false, "dry run mode")
 	cmd.PersistentFlags().StringVar(&proxyUser, "apisix-user", "nobody", "user to run APISIX")
+	cmd.PersistentFlags().StringVar(&cfg.NetworkNamespace, "network-namespace", "",
+		"path to a Linux network namespace (e.g. /var/run/netns/foo or /proc/<pid>/ns/net) in which to run all iptables invocations, defaults to the caller's own namespace")
 
-	return cmd
-}
-
-func (ic *iptablesConstructor) run() {
-	ic.iptables.AppendRuleV4(
-		log.UndefinedCommand, RedirectChain, "nat", "-p", "tcp", "-j", "REDIRECT", "--to-ports", ic.cfg.ProxyPort,
-	)
-	ic.iptables.AppendRuleV4(
-		log.UndefinedCommand, InboundRedirectChain, "nat", "-p", "tcp",
-		"-j", "REDIRECT", "--to-ports", ic.cfg.InboundCapturePort,
-	)
+	cmd.AddCommand(newCleanCommand(&cfg, &proxyUser))
 
-	// Should first insert these skipping rules.
-	ic.insertSkipRules()
-	ic.insertInboundRules()
-	ic.insertOutboundRules()
-	ic.executeCommand()
+	return cmd
 }
 
-func (ic *iptablesConstructor) insertInboundRules() {
-	if ic.cfg.InboundPortsInclude == "" {
-		return
-	}
-	ic.iptables.AppendRuleV4(log.UndefinedCommand, PreRoutingChain, "nat", "-p", "tcp", "-j", InboundChain)
-
-	if ic.cfg.InboundPortsInclude == "*" {
-		// Makes sure SSH is not redirected
-		ic.iptables.AppendRuleV4(log.UndefinedCommand, InboundChain, "nat", "-p", "tcp", "--dport", "22", "-j", "RETURN")
-		if ic.cfg.InboundPortsExclude != "" {
-			for _, port := range split(ic.cfg.InboundPortsExclude) {
-				ic.iptables.AppendRuleV4(log.UndefinedCommand, InboundChain, "nat", "-p", "tcp", "--dport", port, "-j", "RETURN")
-			}
-		}
-		ic.iptables.AppendRuleV4(log.UndefinedCommand, InboundChain, "nat", "-p", "tcp", "-j", InboundRedirectChain)
-	} else {
-		for _, port := range split(ic.cfg.InboundPortsInclude) {
-			ic.iptables.AppendRuleV4(
-				log.UndefinedCommand, InboundChain, "nat", "-p", "tcp", "--dport", port, "-j", InboundRedirectChain,
-			)
-		}
-	}
-}
+func newCleanCommand(cfg *iptables.Config, proxyUser *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "clean",
+		Short: "Remove iptables rules previously installed by amesh-iptables",
+		Long: `Remove iptables rules previously installed by amesh-iptables.
 
-func (ic *iptablesConstructor) insertOutboundRules() {
-	if ic.cfg.OutboundPortsInclude == "" {
-		return
-	}
-	if ic.cfg.OutboundPortsInclude == "*" {
-		if ic.cfg.OutboundPortsExclude != "" {
-			for _, port := range split(ic.cfg.OutboundPortsExclude) {
-				ic.iptables.AppendRuleV4(
-					log.UndefinedCommand, OutputChain, "nat", "-p", "tcp", "--dport", port, "-j", "RETURN",
-				)
+This flushes and deletes the APISIX_INBOUND, APISIX_REDIRECT and APISIX_INBOUND_REDIRECT chains
+and removes the jumps installed into OUTPUT/PREROUTING. It is safe to run even if install was
+never run, and safe to run before install.
+`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			usr, err := user.Lookup(*proxyUser)
+			if err != nil {
+				return err
 			}
-		}
-		ic.iptables.AppendRuleV4(
-			log.UndefinedCommand, OutputChain, "nat", "-p", "tcp", "-j", RedirectChain,
-		)
-	} else {
-		for _, port := range split(ic.cfg.OutboundPortsInclude) {
-			ic.iptables.AppendRuleV4(
-				log.UndefinedCommand, OutputChain, "nat", "-p", "tcp", "--dport", port, "-j", RedirectChain,
-			)
-		}
-
-	}
-}
-
-func (ic *iptablesConstructor) insertSkipRules() {
-	ic.iptables.AppendRuleV4(log.UndefinedCommand, OutputChain, "nat", "-o", "lo", "!", "-d",
-		"127.0.0.1/32", "-m", "owner", "--uid-owner", ic.cfg.ProxyUID, "-j", "RETURN")
-	ic.iptables.AppendRuleV4(log.UndefinedCommand, OutputChain, "nat", "-m", "owner", "--gid-owner",
-		ic.cfg.ProxyGID, "-j", "RETURN")
-}
-
-func (ic *iptablesConstructor) executeCommand() {
-	commands := ic.iptables.BuildV4()
-	for _, cmd := range commands {
-		if len(cmd) > 1 {
-			ic.dep.RunOrFail(cmd[0], cmd[1:]...)
-		} else {
-			ic.dep.RunOrFail(cmd[0])
-		}
-	}
-}
-
-func split(s string) []string {
-	if s == "" {
-		return nil
-	}
-	return filterEmpty(strings.Split(s, ","))
-}
+			cfg.ProxyUID = usr.Uid
+			cfg.ProxyGID = usr.Gid
 
-func filterEmpty(strs []string) []string {
-	filtered := make([]string, 0, len(strs))
-	for _, s := range strs {
-		if s == "" {
-			continue
-		}
-		filtered = append(filtered, s)
+			return iptables.Clean(*cfg)
+		},
 	}
-	return filtered
 }
 
 func main() {
 	cmd := newCommand()
 	if err := cmd.Execute(); err != nil {
-
 		os.Exit(-1)
 	}
 }
@@ -0,0 +1,139 @@
+// Copyright 2022 The Amesh Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package iptables_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/api7/amesh/pkg/iptables"
+)
+
+// containsRule reports whether any of the built commands contains every
+// want string, in order, somewhere among its arguments.
+func containsRule(commands [][]string, want ...string) bool {
+	for _, cmd := range commands {
+		joined := strings.Join(cmd, " ")
+		matched := true
+		pos := 0
+		for _, w := range want {
+			idx := strings.Index(joined[pos:], w)
+			if idx < 0 {
+				matched = false
+				break
+			}
+			pos += idx + len(w)
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func baseConfig() iptables.Config {
+	return iptables.Config{
+		InboundInterceptionMode: "REDIRECT",
+		InboundCapturePort:      "9081",
+		ProxyPort:               "9080",
+		ProxyUID:                "1337",
+		ProxyGID:                "1337",
+		DryRun:                  true,
+	}
+}
+
+func TestBuildInboundOutboundPorts(t *testing.T) {
+	cfg := baseConfig()
+	cfg.InboundPortsInclude = "80"
+	cfg.OutboundPortsInclude = "80"
+
+	commands := iptables.Build(cfg)
+
+	if !containsRule(commands, "-A", iptables.InboundChain, "--dport", "80", "-j", iptables.InboundRedirectChain) {
+		t.Errorf("expected an inbound redirect rule for port 80, got %v", commands)
+	}
+	if !containsRule(commands, "-A", iptables.OutputChain, "--dport", "80", "-j", iptables.RedirectChain) {
+		t.Errorf("expected an outbound redirect rule for port 80, got %v", commands)
+	}
+}
+
+func TestBuildInboundWildcardExcludesSSH(t *testing.T) {
+	cfg := baseConfig()
+	cfg.InboundPortsInclude = "*"
+
+	commands := iptables.Build(cfg)
+
+	if !containsRule(commands, "-A", iptables.InboundChain, "--dport", "22", "-j", "RETURN") {
+		t.Errorf("expected SSH (port 22) to be excluded from inbound redirection, got %v", commands)
+	}
+	if !containsRule(commands, "-A", iptables.InboundChain, "-j", iptables.InboundRedirectChain) {
+		t.Errorf("expected a catch-all inbound redirect rule, got %v", commands)
+	}
+}
+
+func TestBuildOutboundWildcardExcludePorts(t *testing.T) {
+	cfg := baseConfig()
+	cfg.OutboundPortsInclude = "*"
+	cfg.OutboundPortsExclude = "443"
+
+	commands := iptables.Build(cfg)
+
+	if !containsRule(commands, "-A", iptables.OutputChain, "--dport", "443", "-j", "RETURN") {
+		t.Errorf("expected port 443 to be excluded from outbound redirection, got %v", commands)
+	}
+}
+
+func TestBuildSkipsProxyUIDAndExtraExclusions(t *testing.T) {
+	cfg := baseConfig()
+	cfg.ExcludeUIDs = "1001,1002"
+	cfg.ExcludeGIDs = "2001"
+
+	commands := iptables.Build(cfg)
+
+	if !containsRule(commands, "--uid-owner", "1337", "-j", "RETURN") {
+		t.Errorf("expected a skip rule for the proxy's own uid, got %v", commands)
+	}
+	if !containsRule(commands, "--uid-owner", "1001", "-j", "RETURN") {
+		t.Errorf("expected a skip rule for excluded uid 1001, got %v", commands)
+	}
+	if !containsRule(commands, "--gid-owner", "2001", "-j", "RETURN") {
+		t.Errorf("expected a skip rule for excluded gid 2001, got %v", commands)
+	}
+}
+
+func TestBuildOutboundCIDRExclude(t *testing.T) {
+	cfg := baseConfig()
+	cfg.OutboundPortsInclude = "*"
+	cfg.OutboundIPRangesExclude = "10.0.0.0/8"
+
+	commands := iptables.Build(cfg)
+
+	if !containsRule(commands, "-d", "10.0.0.0/8", "-j", "RETURN") {
+		t.Errorf("expected excluded CIDR to RETURN before redirection, got %v", commands)
+	}
+}
+
+func TestBuildDisabledWhenPortsEmpty(t *testing.T) {
+	cfg := baseConfig()
+
+	commands := iptables.Build(cfg)
+
+	if containsRule(commands, "-A", iptables.PreRoutingChain, "-j", iptables.InboundChain) {
+		t.Errorf("expected no PREROUTING jump when --inbound-ports is empty, got %v", commands)
+	}
+	if containsRule(commands, "-A", iptables.OutputChain, "-j", iptables.RedirectChain) {
+		t.Errorf("expected no outbound redirection when --outbound-ports is empty, got %v", commands)
+	}
+}
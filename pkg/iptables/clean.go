@@ -0,0 +1,116 @@
+// Copyright 2022 The Amesh Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package iptables
+
+import "istio.io/istio/tools/istio-iptables/pkg/log"
+
+const (
+	iptablesBin  = "iptables"
+	ip6tablesBin = "ip6tables"
+)
+
+// cleanChains lists every custom nat-table chain amesh-iptables creates.
+var cleanChains = []string{
+	InboundChain,
+	InboundRedirectChain,
+	RedirectChain,
+	DNSRedirectChain,
+}
+
+// Clean removes the chains and jump rules previously installed by Apply. It
+// is idempotent: a chain or jump that doesn't exist is silently ignored, so
+// Clean is safe to run before Apply (making Apply itself effectively
+// idempotent) and safe to run more than once, e.g. on pod restart.
+func Clean(cfg Config) error {
+	ic := NewConstructor(cfg, dependenciesFor(cfg))
+	return ic.Clean()
+}
+
+// Clean removes the jumps installed into OUTPUT/PREROUTING, then flushes and
+// deletes the chains themselves, for both the nat and (when ip6tables is
+// available) the ip6tables nat table, plus the mangle-table chain and
+// policy-routing entries TPROXY mode installs. Mirrors the design of
+// Istio's istio-clean-iptables: deletes are attempted unconditionally and
+// failures (the jump, chain or routing entry was never installed) are
+// ignored rather than treated as errors.
+func (ic *Constructor) Clean() error {
+	ic.cleanNAT(iptablesBin)
+	if ip6tablesAvailable(ic.dep) {
+		ic.cleanNAT(ip6tablesBin)
+	}
+	ic.cleanTproxy()
+
+	return nil
+}
+
+func (ic *Constructor) cleanNAT(bin string) {
+	ic.dep.RunQuietlyAndIgnore(bin, "-t", "nat", "-D", OutputChain, "-p", "tcp", "-j", RedirectChain)
+	ic.dep.RunQuietlyAndIgnore(bin, "-t", "nat", "-D", PreRoutingChain, "-p", "tcp", "-j", InboundChain)
+	ic.dep.RunQuietlyAndIgnore(bin, "-t", "nat", "-D", OutputChain, "-p", "udp", "--dport", "53", "-j", DNSRedirectChain)
+	ic.dep.RunQuietlyAndIgnore(bin, "-t", "nat", "-D", OutputChain, "-p", "tcp", "--dport", "53", "-j", DNSRedirectChain)
+
+	loopback := "127.0.0.1/32"
+	excludeCIDRs, v6ExcludeCIDRs := splitCIDRsByFamily(ic.cfg.OutboundIPRangesExclude)
+	includeCIDRs, v6IncludeCIDRs := splitCIDRsByFamily(ic.cfg.OutboundIPRangesInclude)
+	if bin == ip6tablesBin {
+		loopback = "::1/128"
+		excludeCIDRs = v6ExcludeCIDRs
+		includeCIDRs = v6IncludeCIDRs
+	}
+	ic.cleanSkipRules(bin, loopback)
+	ic.cleanOutboundExcludeRules(bin, excludeCIDRs)
+	// The per-port and per-CIDR jumps to RedirectChain and the per-port
+	// RETURN excludes also live directly in OUTPUT; delete them with the
+	// same rule generation insertOutboundRulesFamily uses to install them.
+	ic.insertOutboundRulesFamily(func(_ log.CommandScope, chain, table string, params ...string) {
+		ic.dep.RunQuietlyAndIgnore(bin, append([]string{"-t", table, "-D", chain}, params...)...)
+	}, nil, includeCIDRs)
+
+	for _, chain := range cleanChains {
+		ic.dep.RunQuietlyAndIgnore(bin, "-t", "nat", "-F", chain)
+		ic.dep.RunQuietlyAndIgnore(bin, "-t", "nat", "-X", chain)
+	}
+}
+
+// cleanSkipRules removes the OUTPUT-chain RETURN rules insertSkipRulesFamily
+// installs for the proxy's own uid/gid and any additionally configured
+// ExcludeUIDs/ExcludeGIDs. These rules are appended directly into OUTPUT
+// rather than into a custom chain, so they aren't covered by flushing and
+// deleting cleanChains and must be deleted individually.
+func (ic *Constructor) cleanSkipRules(bin, loopback string) {
+	ic.dep.RunQuietlyAndIgnore(bin, "-t", "nat", "-D", OutputChain, "-o", "lo", "!", "-d",
+		loopback, "-m", "owner", "--uid-owner", ic.cfg.ProxyUID, "-j", "RETURN")
+	ic.dep.RunQuietlyAndIgnore(bin, "-t", "nat", "-D", OutputChain, "-m", "owner", "--gid-owner",
+		ic.cfg.ProxyGID, "-j", "RETURN")
+	for _, uid := range split(ic.cfg.ExcludeUIDs) {
+		ic.dep.RunQuietlyAndIgnore(bin, "-t", "nat", "-D", OutputChain, "-m", "owner", "--uid-owner", uid, "-j", "RETURN")
+	}
+	for _, gid := range split(ic.cfg.ExcludeGIDs) {
+		ic.dep.RunQuietlyAndIgnore(bin, "-t", "nat", "-D", OutputChain, "-m", "owner", "--gid-owner", gid, "-j", "RETURN")
+	}
+}
+
+// cleanOutboundExcludeRules removes the OUTPUT-chain RETURN rules
+// insertOutboundRulesFamily installs for KubeVirtInterfaces and
+// OutboundIPRangesExclude, for the same reason cleanSkipRules exists: they
+// live directly in OUTPUT, not in a chain that gets flushed/deleted below.
+func (ic *Constructor) cleanOutboundExcludeRules(bin string, excludeCIDRs []string) {
+	for _, iface := range split(ic.cfg.KubeVirtInterfaces) {
+		ic.dep.RunQuietlyAndIgnore(bin, "-t", "nat", "-D", OutputChain, "-o", iface, "-j", "RETURN")
+	}
+	for _, cidr := range excludeCIDRs {
+		ic.dep.RunQuietlyAndIgnore(bin, "-t", "nat", "-D", OutputChain, "-d", cidr, "-j", "RETURN")
+	}
+}
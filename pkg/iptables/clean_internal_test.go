@@ -0,0 +1,48 @@
+// Copyright 2022 The Amesh Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package iptables
+
+import "testing"
+
+func TestCleanRemovesOutputChainSkipAndExcludeRules(t *testing.T) {
+	cfg := Config{
+		ProxyUID:                "1337",
+		ProxyGID:                "1337",
+		ExcludeUIDs:             "1001",
+		ExcludeGIDs:             "2001",
+		KubeVirtInterfaces:      "eth10",
+		OutboundIPRangesExclude: "10.0.0.0/8",
+	}
+	dep := &fakeDependencies{}
+	ic := NewConstructor(cfg, dep)
+
+	if err := ic.Clean(); err != nil {
+		t.Fatalf("Clean returned an error: %v", err)
+	}
+
+	wants := [][]string{
+		{"-D", OutputChain, "--uid-owner", "1337", "-j", "RETURN"},
+		{"-D", OutputChain, "--gid-owner", "1337", "-j", "RETURN"},
+		{"-D", OutputChain, "--uid-owner", "1001", "-j", "RETURN"},
+		{"-D", OutputChain, "--gid-owner", "2001", "-j", "RETURN"},
+		{"-D", OutputChain, "-o", "eth10", "-j", "RETURN"},
+		{"-D", OutputChain, "-d", "10.0.0.0/8", "-j", "RETURN"},
+	}
+	for _, want := range wants {
+		if !dep.contains(want...) {
+			t.Errorf("expected Clean to issue a deletion matching %v, got %v", want, dep.ran)
+		}
+	}
+}
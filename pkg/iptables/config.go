@@ -0,0 +1,109 @@
+// Copyright 2022 The Amesh Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package iptables
+
+// Config controls how Apply/Build generate and install the iptables rules
+// used to redirect traffic to APISIX. It mirrors the flag surface of the
+// amesh-iptables command so that callers other than the CLI (a CNI plugin,
+// an init container, tests) can drive the same logic programmatically.
+type Config struct {
+	// InboundInterceptionMode selects how inbound traffic is captured:
+	// "REDIRECT" (default) or "TPROXY".
+	InboundInterceptionMode string
+	// TproxyMark is the fwmark (and mask) TPROXY mode uses to mark inbound
+	// packets so the policy routing rules can steer them to APISIX. Only
+	// used when InboundInterceptionMode is "TPROXY".
+	TproxyMark string
+	// TproxyRouteTable is the routing table id that the fwmark-based ip
+	// rule/ip route entries use for TPROXY mode.
+	TproxyRouteTable string
+	// InboundCapturePort is the port APISIX listens on for inbound traffic
+	// redirected by the APISIX_INBOUND_REDIRECT chain.
+	InboundCapturePort string
+	// ProxyPort is the port APISIX listens on for outbound traffic
+	// redirected by the APISIX_REDIRECT chain.
+	ProxyPort string
+
+	// InboundPortsInclude is a comma separated list of inbound ports for
+	// which traffic is to be redirected, the wildcard character "*" can be
+	// used to configure redirection for all ports, empty list will disable
+	// the redirection.
+	InboundPortsInclude string
+	// OutboundPortsInclude is a comma separated list of outbound ports for
+	// which traffic is to be redirected.
+	OutboundPortsInclude string
+	// InboundPortsExclude is a comma separated list of inbound ports to be
+	// excluded from forwarding to APISIX, only in effective if the value of
+	// InboundPortsInclude is "*".
+	InboundPortsExclude string
+	// OutboundPortsExclude is a comma separated list of outbound ports to be
+	// excluded from forwarding to APISIX, only in effective if the value of
+	// OutboundPortsInclude is "*".
+	OutboundPortsExclude string
+
+	// ProxyUID is the uid of the user APISIX runs as.
+	ProxyUID string
+	// ProxyGID is the gid of the user APISIX runs as.
+	ProxyGID string
+	// ExcludeUIDs is a comma separated list of additional uids whose
+	// outbound traffic is never redirected to APISIX.
+	ExcludeUIDs string
+	// ExcludeGIDs is a comma separated list of additional gids whose
+	// outbound traffic is never redirected to APISIX.
+	ExcludeGIDs string
+
+	// OutboundIPRangesInclude is a comma separated list of destination CIDRs
+	// for which outbound traffic is to be redirected, the wildcard
+	// character "*" (the default) redirects all destinations.
+	OutboundIPRangesInclude string
+	// OutboundIPRangesExclude is a comma separated list of destination
+	// CIDRs whose outbound traffic is never redirected to APISIX,
+	// regardless of OutboundIPRangesInclude/OutboundPortsInclude.
+	OutboundIPRangesExclude string
+	// KubeVirtInterfaces is a comma separated list of virtual interface
+	// names (e.g. those added by Kubevirt) whose outbound traffic should
+	// bypass APISIX redirection entirely.
+	KubeVirtInterfaces string
+
+	// DryRun, when true, prints the rules that would be installed instead of
+	// running iptables.
+	DryRun bool
+
+	// NetworkNamespace, when non-empty, is the path to a Linux network
+	// namespace (e.g. "/var/run/netns/foo" or "/proc/<pid>/ns/net") that all
+	// iptables invocations run inside of, instead of the caller's own netns.
+	NetworkNamespace string
+
+	// EnableInboundIPv6 additionally generates and installs ip6tables rules
+	// for inbound traffic. Off by default for backward compatibility.
+	EnableInboundIPv6 bool
+	// EnableOutboundIPv6 additionally generates and installs ip6tables
+	// rules for outbound traffic. Off by default for backward
+	// compatibility.
+	EnableOutboundIPv6 bool
+	// DualStack is a convenience that enables both EnableInboundIPv6 and
+	// EnableOutboundIPv6.
+	DualStack bool
+
+	// RedirectDNS, when true, captures outbound DNS traffic (port 53, UDP
+	// and TCP) and DNATs it to DNSUpstreamIP:DNSUpstreamPort.
+	RedirectDNS bool
+	// DNSUpstreamIP is the local resolver DNS traffic is redirected to when
+	// RedirectDNS is set.
+	DNSUpstreamIP string
+	// DNSUpstreamPort is the port of the local resolver DNS traffic is
+	// redirected to when RedirectDNS is set.
+	DNSUpstreamPort string
+}
@@ -0,0 +1,172 @@
+// Copyright 2022 The Amesh Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Package iptables implements the rule generation and installation logic
+// behind the amesh-iptables command. It is kept independent from cobra so
+// that other Amesh components (a CNI plugin, an init container, tests) can
+// reuse it without shelling out to the binary.
+package iptables
+
+import (
+	"istio.io/istio/tools/istio-iptables/pkg/builder"
+	iptablesconf "istio.io/istio/tools/istio-iptables/pkg/config"
+	"istio.io/istio/tools/istio-iptables/pkg/dependencies"
+)
+
+const (
+	InboundChain         = "APISIX_INBOUND"
+	RedirectChain        = "APISIX_REDIRECT"
+	InboundRedirectChain = "APISIX_INBOUND_REDIRECT"
+	OutputChain          = "OUTPUT"
+	PreRoutingChain      = "PREROUTING"
+)
+
+// Constructor builds and, unless running in dry-run mode, installs the
+// iptables rules described by a Config.
+type Constructor struct {
+	iptables *builder.IptablesBuilder
+	cfg      *Config
+	dep      dependencies.Dependencies
+
+	// enableInboundV6/enableOutboundV6 resolve cfg.EnableInboundIPv6/
+	// cfg.EnableOutboundIPv6 (as widened by cfg.DualStack) against whether
+	// ip6tables is actually usable through dep.
+	enableInboundV6  bool
+	enableOutboundV6 bool
+}
+
+// NewConstructor creates a Constructor for the given Config. dep is
+// typically a dependencies.StdoutStubDependencies (for dry-run) or a
+// dependencies.RealDependencies.
+func NewConstructor(cfg Config, dep dependencies.Dependencies) *Constructor {
+	wantInboundV6 := cfg.EnableInboundIPv6 || cfg.DualStack
+	wantOutboundV6 := cfg.EnableOutboundIPv6 || cfg.DualStack
+	haveV6 := (wantInboundV6 || wantOutboundV6) && ip6tablesAvailable(dep)
+
+	return &Constructor{
+		iptables:         builder.NewIptablesBuilder(toIstioConfig(&cfg)),
+		cfg:              &cfg,
+		dep:              dep,
+		enableInboundV6:  wantInboundV6 && haveV6,
+		enableOutboundV6: wantOutboundV6 && haveV6,
+	}
+}
+
+func toIstioConfig(cfg *Config) *iptablesconf.Config {
+	return &iptablesconf.Config{
+		InboundInterceptionMode: cfg.InboundInterceptionMode,
+		InboundCapturePort:      cfg.InboundCapturePort,
+		ProxyPort:               cfg.ProxyPort,
+		InboundPortsInclude:     cfg.InboundPortsInclude,
+		OutboundPortsInclude:    cfg.OutboundPortsInclude,
+		InboundPortsExclude:     cfg.InboundPortsExclude,
+		OutboundPortsExclude:    cfg.OutboundPortsExclude,
+		DryRun:                  cfg.DryRun,
+		ProxyUID:                cfg.ProxyUID,
+		ProxyGID:                cfg.ProxyGID,
+	}
+}
+
+// Apply builds the iptables rules described by cfg and installs them (or,
+// in dry-run mode, prints them to stdout).
+func Apply(cfg Config) error {
+	dep := dependenciesFor(cfg)
+	ic := NewConstructor(cfg, dep)
+	return ic.Run()
+}
+
+// Build returns the raw iptables commands that Apply would execute, without
+// running them.
+func Build(cfg Config) [][]string {
+	ic := NewConstructor(cfg, dependenciesFor(cfg))
+	ic.insertRedirectChainRules()
+	ic.insertSkipRules()
+	if ic.cfg.InboundInterceptionMode == InboundInterceptionModeTproxy {
+		ic.insertInboundTproxyRules()
+	} else {
+		ic.insertInboundRules()
+	}
+	ic.insertOutboundRules()
+	ic.insertDNSRedirectRules()
+	commands := ic.iptables.BuildV4()
+	if ic.enableInboundV6 || ic.enableOutboundV6 {
+		commands = append(commands, ic.iptables.BuildV6()...)
+	}
+	return commands
+}
+
+func dependenciesFor(cfg Config) dependencies.Dependencies {
+	if cfg.DryRun {
+		// Dry-run must stay a pure preview: entering a network namespace
+		// requires CAP_SYS_ADMIN and a real namespace to switch into, which
+		// defeats the point of a side-effect-free run.
+		return &dependencies.StdoutStubDependencies{}
+	}
+	var dep dependencies.Dependencies = &dependencies.RealDependencies{}
+	if cfg.NetworkNamespace != "" {
+		dep = newNetnsDependencies(cfg.NetworkNamespace, dep)
+	}
+	return dep
+}
+
+// Run installs the base redirect chains, the skip/inbound/outbound rules
+// derived from the Config, then executes the resulting commands.
+func (ic *Constructor) Run() error {
+	ic.insertRedirectChainRules()
+
+	// Should first insert these skipping rules.
+	ic.insertSkipRules()
+	if ic.cfg.InboundInterceptionMode == InboundInterceptionModeTproxy {
+		ic.insertInboundTproxyRules()
+	} else {
+		ic.insertInboundRules()
+	}
+	ic.insertOutboundRules()
+	ic.insertDNSRedirectRules()
+	if err := ic.ExecuteCommand(); err != nil {
+		return err
+	}
+	if ic.cfg.InboundInterceptionMode == InboundInterceptionModeTproxy {
+		return ic.setupTproxyRouting()
+	}
+	return nil
+}
+
+// insertRedirectChainRules installs the REDIRECT rules that APISIX_REDIRECT
+// and APISIX_INBOUND_REDIRECT consist of. In TPROXY mode the inbound side is
+// handled by insertInboundTproxyRules instead, so InboundRedirectChain is
+// only populated here for REDIRECT mode.
+func (ic *Constructor) insertRedirectChainRules() {
+	ic.iptables.AppendRuleV4(
+		undefinedCommand, RedirectChain, "nat", "-p", "tcp", "-j", "REDIRECT", "--to-ports", ic.cfg.ProxyPort,
+	)
+	if ic.enableOutboundV6 {
+		ic.iptables.AppendRuleV6(
+			undefinedCommand, RedirectChain, "nat", "-p", "tcp", "-j", "REDIRECT", "--to-ports", ic.cfg.ProxyPort,
+		)
+	}
+	if ic.cfg.InboundInterceptionMode == InboundInterceptionModeTproxy {
+		return
+	}
+	ic.iptables.AppendRuleV4(
+		undefinedCommand, InboundRedirectChain, "nat", "-p", "tcp",
+		"-j", "REDIRECT", "--to-ports", ic.cfg.InboundCapturePort,
+	)
+	if ic.enableInboundV6 {
+		ic.iptables.AppendRuleV6(
+			undefinedCommand, InboundRedirectChain, "nat", "-p", "tcp",
+			"-j", "REDIRECT", "--to-ports", ic.cfg.InboundCapturePort,
+		)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2022 The Amesh Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package iptables
+
+// DNSRedirectChain captures outbound DNS traffic so it can be pointed at a
+// local resolver (e.g. a node-local CoreDNS or an APISIX-side DNS proxy)
+// instead of whatever nameserver the pod would otherwise reach.
+const DNSRedirectChain = "APISIX_DNS_REDIRECT"
+
+// insertDNSRedirectRules, when cfg.RedirectDNS is set, jumps outbound UDP
+// and TCP DNS traffic into DNSRedirectChain, which DNATs it to
+// DNSUpstreamIP:DNSUpstreamPort. The proxy's own uid/gid is skipped so the
+// configured resolver can still make its own upstream queries.
+func (ic *Constructor) insertDNSRedirectRules() {
+	if !ic.cfg.RedirectDNS {
+		return
+	}
+
+	ic.iptables.AppendRuleV4(undefinedCommand, DNSRedirectChain, "nat", "-m", "owner", "--uid-owner", ic.cfg.ProxyUID, "-j", "RETURN")
+	ic.iptables.AppendRuleV4(undefinedCommand, DNSRedirectChain, "nat", "-m", "owner", "--gid-owner", ic.cfg.ProxyGID, "-j", "RETURN")
+	ic.iptables.AppendRuleV4(
+		undefinedCommand, DNSRedirectChain, "nat", "-p", "udp",
+		"-j", "DNAT", "--to-destination", ic.cfg.DNSUpstreamIP+":"+ic.cfg.DNSUpstreamPort,
+	)
+	ic.iptables.AppendRuleV4(
+		undefinedCommand, DNSRedirectChain, "nat", "-p", "tcp",
+		"-j", "DNAT", "--to-destination", ic.cfg.DNSUpstreamIP+":"+ic.cfg.DNSUpstreamPort,
+	)
+
+	ic.iptables.AppendRuleV4(undefinedCommand, OutputChain, "nat", "-p", "udp", "--dport", "53", "-j", DNSRedirectChain)
+	ic.iptables.AppendRuleV4(undefinedCommand, OutputChain, "nat", "-p", "tcp", "--dport", "53", "-j", DNSRedirectChain)
+}
@@ -0,0 +1,49 @@
+// Copyright 2022 The Amesh Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package iptables
+
+import (
+	"net"
+
+	"istio.io/istio/tools/istio-iptables/pkg/dependencies"
+)
+
+// ip6tablesAvailable reports whether ip6tables can be invoked through dep.
+// IPv6 rule generation is skipped when it can't, even if the caller asked
+// for it, since a pod/node without IPv6 support has no ip6tables binary (or
+// kernel module) to program.
+func ip6tablesAvailable(dep dependencies.Dependencies) bool {
+	return dep.Run("ip6tables", "--version") == nil
+}
+
+// splitCIDRsByFamily splits a comma separated list of CIDRs into IPv4 and
+// IPv6 buckets so that each can be handed to the matching AppendRuleV4/
+// AppendRuleV6 call. Entries that fail to parse are dropped into the IPv4
+// bucket unchanged, to preserve prior (IPv4-only) behavior for malformed
+// input.
+func splitCIDRsByFamily(s string) (v4, v6 []string) {
+	for _, cidr := range split(s) {
+		if cidr == "*" {
+			continue
+		}
+		ip, _, err := net.ParseCIDR(cidr)
+		if err == nil && ip.To4() == nil {
+			v6 = append(v6, cidr)
+			continue
+		}
+		v4 = append(v4, cidr)
+	}
+	return v4, v6
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 The Amesh Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package iptables
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/vishvananda/netns"
+	"istio.io/istio/tools/istio-iptables/pkg/dependencies"
+)
+
+// netnsDependencies wraps a dependencies.Dependencies so that every command
+// it runs executes inside a target Linux network namespace instead of the
+// caller's. This is what lets amesh-iptables run on the host but still
+// program a pod's netns, e.g. from a CNI plugin.
+type netnsDependencies struct {
+	dependencies.Dependencies
+
+	nsPath string
+}
+
+// newNetnsDependencies wraps dep so that every command runs inside the
+// namespace at nsPath (e.g. "/var/run/netns/foo" or "/proc/<pid>/ns/net").
+func newNetnsDependencies(nsPath string, dep dependencies.Dependencies) dependencies.Dependencies {
+	return &netnsDependencies{Dependencies: dep, nsPath: nsPath}
+}
+
+func (n *netnsDependencies) RunOrFail(cmd string, args ...string) {
+	restore, err := n.enter()
+	if err != nil {
+		panic(err)
+	}
+	defer restore()
+	n.Dependencies.RunOrFail(cmd, args...)
+}
+
+func (n *netnsDependencies) Run(cmd string, args ...string) error {
+	restore, err := n.enter()
+	if err != nil {
+		return err
+	}
+	defer restore()
+	return n.Dependencies.Run(cmd, args...)
+}
+
+func (n *netnsDependencies) RunQuietlyAndIgnore(cmd string, args ...string) {
+	restore, err := n.enter()
+	if err != nil {
+		return
+	}
+	defer restore()
+	n.Dependencies.RunQuietlyAndIgnore(cmd, args...)
+}
+
+// enter locks the calling goroutine to its OS thread and switches that
+// thread into the target netns, returning a function that restores the
+// thread's original namespace and unlocks it. Locking the OS thread is
+// required because namespace membership is per-thread, not per-goroutine.
+func (n *netnsDependencies) enter() (func(), error) {
+	runtime.LockOSThread()
+
+	origNs, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("failed to get current network namespace: %w", err)
+	}
+
+	targetNs, err := netns.GetFromPath(n.nsPath)
+	if err != nil {
+		origNs.Close()
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("failed to open network namespace %q: %w", n.nsPath, err)
+	}
+	defer targetNs.Close()
+
+	if err := netns.Set(targetNs); err != nil {
+		origNs.Close()
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("failed to enter network namespace %q: %w", n.nsPath, err)
+	}
+
+	return func() {
+		defer runtime.UnlockOSThread()
+		defer origNs.Close()
+		_ = netns.Set(origNs)
+	}, nil
+}
@@ -0,0 +1,210 @@
+// Copyright 2022 The Amesh Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package iptables
+
+import (
+	"strings"
+
+	"istio.io/istio/tools/istio-iptables/pkg/dependencies"
+	"istio.io/istio/tools/istio-iptables/pkg/log"
+)
+
+const undefinedCommand = log.UndefinedCommand
+
+// appendRuleFunc matches the signature shared by builder.IptablesBuilder's
+// AppendRuleV4 and AppendRuleV6, letting the rule-generation logic below run
+// once per address family instead of being duplicated.
+type appendRuleFunc func(cmd log.CommandScope, chain, table string, params ...string)
+
+func (ic *Constructor) insertInboundRules() {
+	ic.insertInboundRulesFamily(ic.iptables.AppendRuleV4)
+	if ic.enableInboundV6 {
+		ic.insertInboundRulesFamily(ic.iptables.AppendRuleV6)
+	}
+}
+
+func (ic *Constructor) insertInboundRulesFamily(appendRule appendRuleFunc) {
+	if ic.cfg.InboundPortsInclude == "" {
+		return
+	}
+	appendRule(undefinedCommand, PreRoutingChain, "nat", "-p", "tcp", "-j", InboundChain)
+
+	if ic.cfg.InboundPortsInclude == "*" {
+		// Makes sure SSH is not redirected
+		appendRule(undefinedCommand, InboundChain, "nat", "-p", "tcp", "--dport", "22", "-j", "RETURN")
+		if ic.cfg.InboundPortsExclude != "" {
+			for _, port := range split(ic.cfg.InboundPortsExclude) {
+				appendRule(undefinedCommand, InboundChain, "nat", "-p", "tcp", "--dport", port, "-j", "RETURN")
+			}
+		}
+		appendRule(undefinedCommand, InboundChain, "nat", "-p", "tcp", "-j", InboundRedirectChain)
+	} else {
+		for _, port := range split(ic.cfg.InboundPortsInclude) {
+			appendRule(
+				undefinedCommand, InboundChain, "nat", "-p", "tcp", "--dport", port, "-j", InboundRedirectChain,
+			)
+		}
+	}
+}
+
+func (ic *Constructor) insertOutboundRules() {
+	v4Excludes, v6Excludes := splitCIDRsByFamily(ic.cfg.OutboundIPRangesExclude)
+	v4Includes, v6Includes := splitCIDRsByFamily(ic.cfg.OutboundIPRangesInclude)
+
+	ic.insertOutboundRulesFamily(ic.iptables.AppendRuleV4, v4Excludes, v4Includes)
+	if ic.enableOutboundV6 {
+		ic.insertOutboundRulesFamily(ic.iptables.AppendRuleV6, v6Excludes, v6Includes)
+	}
+}
+
+func (ic *Constructor) insertOutboundRulesFamily(appendRule appendRuleFunc, excludeCIDRs, includeCIDRs []string) {
+	for _, iface := range split(ic.cfg.KubeVirtInterfaces) {
+		appendRule(undefinedCommand, OutputChain, "nat", "-o", iface, "-j", "RETURN")
+	}
+	for _, cidr := range excludeCIDRs {
+		appendRule(undefinedCommand, OutputChain, "nat", "-d", cidr, "-j", "RETURN")
+	}
+
+	if ic.cfg.OutboundPortsInclude == "" {
+		return
+	}
+	if ic.cfg.OutboundPortsInclude == "*" {
+		if ic.cfg.OutboundPortsExclude != "" {
+			for _, port := range split(ic.cfg.OutboundPortsExclude) {
+				appendRule(
+					undefinedCommand, OutputChain, "nat", "-p", "tcp", "--dport", port, "-j", "RETURN",
+				)
+			}
+		}
+		ic.appendOutboundRedirectJump(appendRule, includeCIDRs, "-p", "tcp")
+	} else {
+		for _, port := range split(ic.cfg.OutboundPortsInclude) {
+			ic.appendOutboundRedirectJump(appendRule, includeCIDRs, "-p", "tcp", "--dport", port)
+		}
+	}
+}
+
+// appendOutboundRedirectJump appends the jump(s) to RedirectChain for
+// traffic matched by matchArgs. When OutboundIPRangesInclude is set to
+// something other than "*" (the default, meaning every destination), the
+// jump is scoped to each of this address family's included CIDRs instead of
+// being unconditional. If the include list is explicit but this family has
+// no CIDRs in it (e.g. an IPv4-only include list under --dual-stack), no
+// jump is emitted for this family at all: an explicit include list means
+// "only these destinations", not "everything, since none were configured
+// for this family".
+func (ic *Constructor) appendOutboundRedirectJump(appendRule appendRuleFunc, includeCIDRs []string, matchArgs ...string) {
+	if ic.cfg.OutboundIPRangesInclude == "" || ic.cfg.OutboundIPRangesInclude == "*" {
+		args := append(append([]string{}, matchArgs...), "-j", RedirectChain)
+		appendRule(undefinedCommand, OutputChain, "nat", args...)
+		return
+	}
+	for _, cidr := range includeCIDRs {
+		args := append(append([]string{}, matchArgs...), "-d", cidr, "-j", RedirectChain)
+		appendRule(undefinedCommand, OutputChain, "nat", args...)
+	}
+}
+
+func (ic *Constructor) insertSkipRules() {
+	ic.insertSkipRulesFamily(ic.iptables.AppendRuleV4, "127.0.0.1/32")
+	if ic.enableOutboundV6 {
+		ic.insertSkipRulesFamily(ic.iptables.AppendRuleV6, "::1/128")
+	}
+}
+
+func (ic *Constructor) insertSkipRulesFamily(appendRule appendRuleFunc, loopback string) {
+	appendRule(undefinedCommand, OutputChain, "nat", "-o", "lo", "!", "-d",
+		loopback, "-m", "owner", "--uid-owner", ic.cfg.ProxyUID, "-j", "RETURN")
+	appendRule(undefinedCommand, OutputChain, "nat", "-m", "owner", "--gid-owner",
+		ic.cfg.ProxyGID, "-j", "RETURN")
+	for _, uid := range split(ic.cfg.ExcludeUIDs) {
+		appendRule(undefinedCommand, OutputChain, "nat", "-m", "owner", "--uid-owner", uid, "-j", "RETURN")
+	}
+	for _, gid := range split(ic.cfg.ExcludeGIDs) {
+		appendRule(undefinedCommand, OutputChain, "nat", "-m", "owner", "--gid-owner", gid, "-j", "RETURN")
+	}
+}
+
+// ExecuteCommand runs (or, in dry-run mode, prints) the rules that have been
+// queued onto the underlying builder so far, for both address families.
+func (ic *Constructor) ExecuteCommand() error {
+	if err := runCommands(ic.dep, ic.iptables.BuildV4()); err != nil {
+		return err
+	}
+	if ic.enableInboundV6 || ic.enableOutboundV6 {
+		return runCommands(ic.dep, ic.iptables.BuildV6())
+	}
+	return nil
+}
+
+// runCommands executes the built iptables commands, skipping any rule or
+// chain that has already been installed. This mirrors Docker's
+// ExistsNative/Exists approach and is what makes re-running amesh-iptables
+// (e.g. after a pod restart, or when a CNI plugin invokes the same logic
+// more than once for a node) safe: a "-A" append is preceded by a "-C"
+// existence check, and a "-N" chain creation is preceded by a "-L" listing,
+// so only genuinely missing rules/chains are ever added.
+func runCommands(dep dependencies.Dependencies, commands [][]string) error {
+	for _, cmd := range commands {
+		if checkArgs, ok := existenceCheckArgs(cmd); ok && len(checkArgs) > 1 && dep.Run(checkArgs[0], checkArgs[1:]...) == nil {
+			// Already present, nothing to do.
+			continue
+		}
+		if len(cmd) > 1 {
+			dep.RunOrFail(cmd[0], cmd[1:]...)
+		} else {
+			dep.RunOrFail(cmd[0])
+		}
+	}
+	return nil
+}
+
+// existenceCheckArgs turns a rule-append ("-A") or chain-create ("-N")
+// command into the equivalent existence check ("-C" / "-L"). ok is false
+// for commands (like flushes) that have no natural existence check, in
+// which case the caller should just run them.
+func existenceCheckArgs(cmd []string) (checkArgs []string, ok bool) {
+	for i, arg := range cmd {
+		switch arg {
+		case "-A":
+			checkArgs = append([]string{}, cmd...)
+			checkArgs[i] = "-C"
+			return checkArgs, true
+		case "-N":
+			checkArgs = append([]string{}, cmd...)
+			checkArgs[i] = "-L"
+			return checkArgs, true
+		}
+	}
+	return nil, false
+}
+
+func split(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return filterEmpty(strings.Split(s, ","))
+}
+
+func filterEmpty(strs []string) []string {
+	filtered := make([]string, 0, len(strs))
+	for _, s := range strs {
+		if s == "" {
+			continue
+		}
+		filtered = append(filtered, s)
+	}
+	return filtered
+}
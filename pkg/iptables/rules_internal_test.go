@@ -0,0 +1,153 @@
+// Copyright 2022 The Amesh Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package iptables
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExistenceCheckArgs(t *testing.T) {
+	cases := []struct {
+		name   string
+		cmd    []string
+		want   []string
+		wantOK bool
+	}{
+		{
+			name:   "append rule becomes a check",
+			cmd:    []string{"iptables", "-t", "nat", "-A", "APISIX_REDIRECT", "-p", "tcp", "-j", "REDIRECT"},
+			want:   []string{"iptables", "-t", "nat", "-C", "APISIX_REDIRECT", "-p", "tcp", "-j", "REDIRECT"},
+			wantOK: true,
+		},
+		{
+			name:   "chain creation becomes a listing",
+			cmd:    []string{"iptables", "-t", "nat", "-N", "APISIX_REDIRECT"},
+			want:   []string{"iptables", "-t", "nat", "-L", "APISIX_REDIRECT"},
+			wantOK: true,
+		},
+		{
+			name:   "a flush has no natural existence check",
+			cmd:    []string{"iptables", "-t", "nat", "-F", "APISIX_REDIRECT"},
+			wantOK: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			original := append([]string{}, c.cmd...)
+
+			got, ok := existenceCheckArgs(c.cmd)
+			if ok != c.wantOK {
+				t.Fatalf("existenceCheckArgs(%v) ok = %v, want %v", c.cmd, ok, c.wantOK)
+			}
+			if ok && !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("existenceCheckArgs(%v) = %v, want %v", c.cmd, got, c.want)
+			}
+			// The original command must never be mutated in place.
+			if !reflect.DeepEqual(c.cmd, original) {
+				t.Fatalf("existenceCheckArgs mutated the input command: got %v, want %v", c.cmd, original)
+			}
+		})
+	}
+}
+
+type fakeDependencies struct {
+	existing map[string]bool
+	ran      [][]string
+}
+
+func (f *fakeDependencies) key(cmd string, args ...string) string {
+	return cmd + " " + strings.Join(args, " ")
+}
+
+func (f *fakeDependencies) RunOrFail(cmd string, args ...string) {
+	f.ran = append(f.ran, append([]string{cmd}, args...))
+}
+
+func (f *fakeDependencies) Run(cmd string, args ...string) error {
+	if f.existing[f.key(cmd, args...)] {
+		return nil
+	}
+	return errNotFound
+}
+
+func (f *fakeDependencies) RunQuietlyAndIgnore(cmd string, args ...string) {
+	f.ran = append(f.ran, append([]string{cmd}, args...))
+}
+
+// contains reports whether any recorded command contains every string in
+// want, in order, somewhere among its arguments.
+func (f *fakeDependencies) contains(want ...string) bool {
+	for _, cmd := range f.ran {
+		joined := strings.Join(cmd, " ")
+		matched := true
+		pos := 0
+		for _, w := range want {
+			idx := strings.Index(joined[pos:], w)
+			if idx < 0 {
+				matched = false
+				break
+			}
+			pos += idx + len(w)
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+var errNotFound = &notFoundError{}
+
+type notFoundError struct{}
+
+func (*notFoundError) Error() string { return "not found" }
+
+func TestRunCommandsSkipsExistingRules(t *testing.T) {
+	dep := &fakeDependencies{
+		existing: map[string]bool{
+			"iptables -t nat -C APISIX_REDIRECT -p tcp -j REDIRECT": true,
+		},
+	}
+
+	commands := [][]string{
+		{"iptables", "-t", "nat", "-N", "APISIX_REDIRECT"},
+		{"iptables", "-t", "nat", "-A", "APISIX_REDIRECT", "-p", "tcp", "-j", "REDIRECT"},
+	}
+
+	if err := runCommands(dep, commands); err != nil {
+		t.Fatalf("runCommands returned an error: %v", err)
+	}
+
+	if len(dep.ran) != 1 {
+		t.Fatalf("expected only the missing chain to be created, got %v", dep.ran)
+	}
+	if dep.ran[0][3] != "-N" {
+		t.Fatalf("expected the chain creation to run, got %v", dep.ran[0])
+	}
+}
+
+func TestSplitCIDRsByFamily(t *testing.T) {
+	v4, v6 := splitCIDRsByFamily("10.0.0.0/8,fd00::/8,*,192.168.0.0/16")
+
+	if !reflect.DeepEqual(v4, []string{"10.0.0.0/8", "192.168.0.0/16"}) {
+		t.Errorf("unexpected v4 CIDRs: %v", v4)
+	}
+	if !reflect.DeepEqual(v6, []string{"fd00::/8"}) {
+		t.Errorf("unexpected v6 CIDRs: %v", v6)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 The Amesh Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package iptables
+
+import "strings"
+
+const (
+	// InboundTproxyMarkChain marks inbound packets destined for intercepted
+	// ports so the policy routing rules installed by setupTproxyRouting can
+	// steer them into the local TPROXY socket.
+	InboundTproxyMarkChain = "APISIX_INBOUND_TPROXY_MARK"
+
+	ipBin = "ip"
+
+	// InboundInterceptionModeTproxy intercepts inbound traffic with TPROXY
+	// instead of REDIRECT, which preserves the original source address.
+	InboundInterceptionModeTproxy = "TPROXY"
+)
+
+// insertInboundTproxyRules installs the mangle-table chain that marks
+// inbound packets for TPROXY interception, in place of the NAT REDIRECT
+// path used by insertInboundRules. It is gated by InboundPortsInclude/
+// InboundPortsExclude in exactly the same way as insertInboundRulesFamily,
+// so TPROXY mode gets the same "only intercept these ports" and "never
+// intercept SSH" guarantees as REDIRECT mode.
+func (ic *Constructor) insertInboundTproxyRules() {
+	if ic.cfg.InboundPortsInclude == "" {
+		return
+	}
+	ic.iptables.AppendRuleV4(undefinedCommand, PreRoutingChain, "mangle", "-p", "tcp", "-j", InboundTproxyMarkChain)
+
+	if ic.cfg.InboundPortsInclude == "*" {
+		// Makes sure SSH is not redirected
+		ic.iptables.AppendRuleV4(undefinedCommand, InboundTproxyMarkChain, "mangle", "-p", "tcp", "--dport", "22", "-j", "RETURN")
+		if ic.cfg.InboundPortsExclude != "" {
+			for _, port := range split(ic.cfg.InboundPortsExclude) {
+				ic.iptables.AppendRuleV4(undefinedCommand, InboundTproxyMarkChain, "mangle", "-p", "tcp", "--dport", port, "-j", "RETURN")
+			}
+		}
+		ic.iptables.AppendRuleV4(
+			undefinedCommand, InboundTproxyMarkChain, "mangle", "-p", "tcp",
+			"-j", "TPROXY",
+			"--tproxy-mark", ic.cfg.TproxyMark+"/"+ic.cfg.TproxyMark,
+			"--on-port", ic.cfg.InboundCapturePort,
+		)
+	} else {
+		for _, port := range split(ic.cfg.InboundPortsInclude) {
+			ic.iptables.AppendRuleV4(
+				undefinedCommand, InboundTproxyMarkChain, "mangle", "-p", "tcp", "--dport", port,
+				"-j", "TPROXY",
+				"--tproxy-mark", ic.cfg.TproxyMark+"/"+ic.cfg.TproxyMark,
+				"--on-port", ic.cfg.InboundCapturePort,
+			)
+		}
+	}
+}
+
+// setupTproxyRouting installs the policy routing (ip rule / ip route)
+// needed for locally-marked packets to reach the TPROXY socket: packets
+// carrying the configured fwmark are looked up in a dedicated routing table
+// that resolves them as local, so the kernel delivers them to the listening
+// socket instead of routing them normally. Re-adding an entry that is
+// already present is not treated as an error, so running install twice in
+// TPROXY mode stays safe.
+func (ic *Constructor) setupTproxyRouting() error {
+	if err := ignoreExists(ic.dep.Run(ipBin, "rule", "add", "fwmark", ic.cfg.TproxyMark, "lookup", ic.cfg.TproxyRouteTable)); err != nil {
+		return err
+	}
+	return ignoreExists(ic.dep.Run(ipBin, "route", "add", "local", "0.0.0.0/0", "dev", "lo", "table", ic.cfg.TproxyRouteTable))
+}
+
+// ignoreExists treats "ip rule/route add" failing because the entry is
+// already present (exit status RTNETLINK reports as "File exists") as
+// success rather than an error.
+func ignoreExists(err error) error {
+	if err == nil || strings.Contains(err.Error(), "File exists") {
+		return nil
+	}
+	return err
+}
+
+// cleanTproxy removes the mangle-table rules and policy-routing entries
+// installed for TPROXY mode. Like the rest of Clean, every step is
+// best-effort: a rule, chain or routing entry that was never installed (or
+// already removed) is ignored rather than treated as an error.
+func (ic *Constructor) cleanTproxy() {
+	ic.dep.RunQuietlyAndIgnore(iptablesBin, "-t", "mangle", "-D", PreRoutingChain, "-p", "tcp", "-j", InboundTproxyMarkChain)
+	ic.dep.RunQuietlyAndIgnore(iptablesBin, "-t", "mangle", "-F", InboundTproxyMarkChain)
+	ic.dep.RunQuietlyAndIgnore(iptablesBin, "-t", "mangle", "-X", InboundTproxyMarkChain)
+
+	if ic.cfg.TproxyMark == "" || ic.cfg.TproxyRouteTable == "" {
+		return
+	}
+	ic.dep.RunQuietlyAndIgnore(ipBin, "rule", "del", "fwmark", ic.cfg.TproxyMark, "lookup", ic.cfg.TproxyRouteTable)
+	ic.dep.RunQuietlyAndIgnore(ipBin, "route", "del", "local", "0.0.0.0/0", "dev", "lo", "table", ic.cfg.TproxyRouteTable)
+}